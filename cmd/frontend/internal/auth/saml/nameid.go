@@ -0,0 +1,53 @@
+package saml
+
+import (
+	"encoding/xml"
+
+	"github.com/pkg/errors"
+)
+
+// PersistedNameID is the SAML NameID issued for a user by the IdP, persisted so that the same
+// local account is re-linked on subsequent logins even if the IdP's asserted email address
+// changes or is anonymized. NameQualifier and SPNameQualifier scope Value the same way the SAML
+// 2.0 core spec does (§8.3.2): two NameIDs are the same principal only if all three match.
+type PersistedNameID struct {
+	Format          string
+	Value           string
+	NameQualifier   string
+	SPNameQualifier string
+}
+
+// samlAssertionSubject is the subset of a SAML <saml:Assertion>'s <saml:Subject> that carries the
+// NameID and its qualifiers. gosaml2's AssertionInfo only surfaces the bare NameID value, so it's
+// parsed out of the raw assertion XML here, the same way unmarshalEntityDescriptor2 hand-parses
+// IdP metadata that isn't otherwise exposed.
+type samlAssertionSubject struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
+	NameID  struct {
+		Format          string `xml:"Format,attr"`
+		NameQualifier   string `xml:"NameQualifier,attr"`
+		SPNameQualifier string `xml:"SPNameQualifier,attr"`
+		Value           string `xml:",chardata"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+}
+
+// parsePersistedNameID extracts the PersistedNameID from the raw, decrypted <saml:Assertion> XML
+// of a validated SAML response.
+//
+// WIP: not yet called from the ACS handler in this checkout, so no NameID is actually persisted
+// against a user record today; see the WIP comment below slo.go's imports.
+func parsePersistedNameID(assertionXML []byte) (PersistedNameID, error) {
+	var subject samlAssertionSubject
+	if err := xml.Unmarshal(assertionXML, &subject); err != nil {
+		return PersistedNameID{}, errors.WithMessage(err, "parsing SAML assertion subject")
+	}
+	if subject.NameID.Value == "" {
+		return PersistedNameID{}, errors.New("SAML assertion subject has no NameID")
+	}
+	return PersistedNameID{
+		Format:          subject.NameID.Format,
+		Value:           subject.NameID.Value,
+		NameQualifier:   subject.NameID.NameQualifier,
+		SPNameQualifier: subject.NameID.SPNameQualifier,
+	}, nil
+}
@@ -59,6 +59,14 @@ func getServiceProvider2(ctx context.Context, pc *schema.SAMLAuthProvider) (*sam
 		}
 	}
 
+	// pc.NameIDFormat lets the site admin pin the format requested of the IdP; it defaults to
+	// persistent so that re-linking a user across logins doesn't depend on the IdP sending a
+	// stable email attribute (some IdPs rotate or anonymize it).
+	nameIDFormat := pc.NameIDFormat
+	if nameIDFormat == "" {
+		nameIDFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	}
+
 	issuerURL := c.entityID.ResolveReference(&url.URL{Path: path.Join(c.entityID.Path, "/saml/metadata")}).String()
 	return &saml2.SAMLServiceProvider{
 		IdentityProviderSSOURL:      metadata.IDPSSODescriptor.SingleSignOnServices[0].Location,
@@ -69,9 +77,8 @@ func getServiceProvider2(ctx context.Context, pc *schema.SAMLAuthProvider) (*sam
 		AudienceURI:                 issuerURL,
 		IDPCertificateStore:         &certStore,
 		SPKeyStore:                  dsig.TLSCertKeyStore(c.keyPair),
-		// TODO(sqs): Use the persistent NameIDFormat (https://github.com/sourcegraph/sourcegraph/issues/11206).
-		NameIdFormat:           "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
-		ValidateEncryptionCert: true,
+		NameIdFormat:                nameIDFormat,
+		ValidateEncryptionCert:      true,
 	}, nil
 }
 
@@ -119,4 +126,4 @@ func unmarshalEntityDescriptor2(data []byte) (*types.EntityDescriptor, error) {
 		}
 	}
 	return entity, nil
-}
\ No newline at end of file
+}
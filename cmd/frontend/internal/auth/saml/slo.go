@@ -0,0 +1,450 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/pkg/errors"
+	saml2 "github.com/russellhaering/gosaml2"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/sourcegraph/sourcegraph/pkg/conf"
+	"github.com/sourcegraph/sourcegraph/schema"
+)
+
+// This file implements SAML 2.0 Single Logout (SLO). gosaml2 (the library getServiceProvider2
+// builds on) has no support for it, so LogoutRequest/LogoutResponse documents are built, signed,
+// verified and parsed by hand here, the same way unmarshalEntityDescriptor2 hand-parses metadata
+// that gosaml2's types don't expose.
+//
+// WIP, not yet wired up: InitiateLogout and serveSLO are a complete, independently-testable
+// building block for SLO, but nothing in this checkout calls them. Reaching feature-complete SLO
+// still requires, outside of this package: registering an HTTP route (e.g. /saml/slo) that
+// dispatches to serveSLO, a local-session store lookup by NameID for serveSLO's terminateSession
+// callback, a call to parsePersistedNameID (nameid.go) from the ACS handler so a NameID exists to
+// pass to InitiateLogout, and a logout-initiating UI action that calls InitiateLogout. This
+// checkout has no HTTP mux or session/user store to wire any of that into, so none of it is done
+// here — treat SLO as unavailable until that follow-up work lands.
+
+const (
+	bindingHTTPRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	bindingHTTPPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	statusSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+)
+
+// singleLogoutService is the <md:SingleLogoutService> location/binding pair parsed out of the
+// IdP's metadata, which getServiceProvider2 does not read today.
+type singleLogoutService struct {
+	Location string
+	Binding  string
+}
+
+// singleLogoutServiceFor re-fetches and re-parses the IdP metadata for pc to find its preferred
+// SingleLogoutService endpoint. It prefers HTTP-Redirect, falling back to HTTP-POST.
+func singleLogoutServiceFor(ctx context.Context, pc *schema.SAMLAuthProvider) (*singleLogoutService, error) {
+	c, err := readProviderConfig(pc, conf.Get().AppURL)
+	if err != nil {
+		return nil, err
+	}
+	idpMetadata, err := readIdentityProviderMetadata(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := unmarshalEntityDescriptor2(idpMetadata)
+	if err != nil {
+		return nil, errors.WithMessage(err, "parsing SAML Identity Provider metadata")
+	}
+
+	var fallback *singleLogoutService
+	for _, slo := range metadata.IDPSSODescriptor.SingleLogoutServices {
+		svc := &singleLogoutService{Location: slo.Location, Binding: slo.Binding}
+		if slo.Binding == bindingHTTPRedirect {
+			return svc, nil
+		}
+		if fallback == nil {
+			fallback = svc
+		}
+	}
+	if fallback == nil {
+		return nil, errors.New("SAML Identity Provider metadata has no SingleLogoutService")
+	}
+	return fallback, nil
+}
+
+// logoutRequestXML is the <samlp:LogoutRequest> we send to the IdP to begin an SP-initiated
+// logout.
+type logoutRequestXML struct {
+	XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutRequest"`
+	ID           string   `xml:"ID,attr"`
+	Version      string   `xml:"Version,attr"`
+	IssueInstant string   `xml:"IssueInstant,attr"`
+	Issuer       string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	NameID       struct {
+		Format          string `xml:"Format,attr"`
+		NameQualifier   string `xml:"NameQualifier,attr,omitempty"`
+		SPNameQualifier string `xml:"SPNameQualifier,attr,omitempty"`
+		Value           string `xml:",chardata"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+	SessionIndex string `xml:"urn:oasis:names:tc:SAML:2.0:protocol SessionIndex,omitempty"`
+}
+
+// logoutResponseXML is the <samlp:LogoutResponse> we send back in reply to an IdP-initiated
+// logout, or that we parse when the IdP replies to our own SP-initiated logout.
+type logoutResponseXML struct {
+	XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutResponse"`
+	ID           string   `xml:"ID,attr"`
+	InResponseTo string   `xml:"InResponseTo,attr,omitempty"`
+	Version      string   `xml:"Version,attr"`
+	IssueInstant string   `xml:"IssueInstant,attr"`
+	Issuer       string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Status       struct {
+		StatusCode struct {
+			Value string `xml:"Value,attr"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+}
+
+// samlID generates a random SAML element ID. Per the SAML 2.0 spec, IDs must not begin with a
+// digit, hence the "_" prefix.
+func samlID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "_" + hex.EncodeToString(b)
+}
+
+// buildLogoutRequest builds the signed (if signLogoutRequests) <samlp:LogoutRequest> for a
+// SAML 2.0 SP-initiated logout of the given NameID/SessionIndex.
+func buildLogoutRequest(sp *saml2.SAMLServiceProvider, signLogoutRequests bool, nameID PersistedNameID, sessionIndex string) (*etree.Element, error) {
+	req := logoutRequestXML{
+		ID:           samlID(),
+		Version:      "2.0",
+		IssueInstant: time.Now().UTC().Format(time.RFC3339),
+		Issuer:       sp.ServiceProviderIssuer,
+		SessionIndex: sessionIndex,
+	}
+	req.NameID.Format = nameID.Format
+	req.NameID.NameQualifier = nameID.NameQualifier
+	req.NameID.SPNameQualifier = nameID.SPNameQualifier
+	req.NameID.Value = nameID.Value
+
+	return marshalAndMaybeSign(req, signLogoutRequests, sp.SPKeyStore)
+}
+
+// buildLogoutResponse builds the signed (if signLogoutRequests) <samlp:LogoutResponse> sent back
+// to the IdP after an IdP-initiated logout.
+func buildLogoutResponse(sp *saml2.SAMLServiceProvider, signLogoutRequests bool, inResponseTo string) (*etree.Element, error) {
+	resp := logoutResponseXML{
+		ID:           samlID(),
+		InResponseTo: inResponseTo,
+		Version:      "2.0",
+		IssueInstant: time.Now().UTC().Format(time.RFC3339),
+		Issuer:       sp.ServiceProviderIssuer,
+	}
+	resp.Status.StatusCode.Value = statusSuccess
+
+	return marshalAndMaybeSign(resp, signLogoutRequests, sp.SPKeyStore)
+}
+
+func marshalAndMaybeSign(v interface{}, sign bool, keyStore dsig.X509KeyStore) (*etree.Element, error) {
+	bs, err := xml.Marshal(v)
+	if err != nil {
+		return nil, errors.WithMessage(err, "marshaling SAML logout element")
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(bs); err != nil {
+		return nil, errors.WithMessage(err, "re-parsing marshaled SAML logout element")
+	}
+	el := doc.Root()
+
+	if !sign {
+		return el, nil
+	}
+	signingCtx := dsig.NewDefaultSigningContext(keyStore)
+	signed, err := signingCtx.SignEnveloped(el)
+	if err != nil {
+		return nil, errors.WithMessage(err, "signing SAML logout element")
+	}
+	return signed, nil
+}
+
+// redirectBindingURL encodes el per the SAML 2.0 HTTP-Redirect binding (deflate, base64, then
+// URL query-escape) and returns destination with the result set as param ("SAMLRequest" or
+// "SAMLResponse"), plus RelayState if non-empty.
+func redirectBindingURL(destination, param string, el *etree.Element, relayState string) (string, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(el.Copy())
+	xmlBytes, err := doc.WriteToBytes()
+	if err != nil {
+		return "", err
+	}
+
+	var deflated bytes.Buffer
+	fw, err := flate.NewWriter(&deflated, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fw.Write(xmlBytes); err != nil {
+		return "", err
+	}
+	if err := fw.Close(); err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set(param, base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	if relayState != "" {
+		q.Set("RelayState", relayState)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+var postBindingFormTemplate = template.Must(template.New("saml-post-binding").Parse(`<!DOCTYPE html>
+<html><body onload="document.forms[0].submit()">
+<form method="post" action="{{.Destination}}">
+<input type="hidden" name="{{.Param}}" value="{{.Value}}" />
+{{if .RelayState}}<input type="hidden" name="RelayState" value="{{.RelayState}}" />{{end}}
+<noscript><input type="submit" value="Continue" /></noscript>
+</form>
+</body></html>`))
+
+// postBindingForm encodes el per the SAML 2.0 HTTP-POST binding (base64 only, no deflate) and
+// returns a self-submitting HTML form that posts it to destination.
+func postBindingForm(destination, param string, el *etree.Element, relayState string) (string, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(el.Copy())
+	xmlBytes, err := doc.WriteToBytes()
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := postBindingFormTemplate.Execute(&buf, struct {
+		Destination string
+		Param       string
+		Value       string
+		RelayState  string
+	}{
+		Destination: destination,
+		Param:       param,
+		Value:       base64.StdEncoding.EncodeToString(xmlBytes),
+		RelayState:  relayState,
+	}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// verifySLOSignature checks that raw carries a valid XML signature from one of the IdP's
+// certificates (sp.IDPCertificateStore, the same store getServiceProvider2 builds for validating
+// assertions), and returns the verified element re-serialized to bytes. Every inbound SLO message
+// must pass through this before it's unmarshaled and acted on: an unsigned or wrongly-signed
+// LogoutRequest must never be able to terminate another user's session.
+func verifySLOSignature(sp *saml2.SAMLServiceProvider, raw []byte) ([]byte, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return nil, errors.WithMessage(err, "parsing SAML SLO message")
+	}
+
+	validationCtx := dsig.NewDefaultValidationContext(sp.IDPCertificateStore)
+	validated, err := validationCtx.Validate(doc.Root())
+	if err != nil {
+		return nil, errors.WithMessage(err, "validating SAML SLO message signature")
+	}
+
+	verifiedDoc := etree.NewDocument()
+	verifiedDoc.SetRoot(validated.Copy())
+	return verifiedDoc.WriteToBytes()
+}
+
+// parseLogoutResponse verifies raw's signature against sp.IDPCertificateStore, then parses and
+// validates the status of a <samlp:LogoutResponse> received from the IdP.
+func parseLogoutResponse(sp *saml2.SAMLServiceProvider, raw []byte) (*logoutResponseXML, error) {
+	verified, err := verifySLOSignature(sp, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp logoutResponseXML
+	if err := xml.Unmarshal(verified, &resp); err != nil {
+		return nil, errors.WithMessage(err, "parsing SAML LogoutResponse")
+	}
+	if resp.Status.StatusCode.Value != statusSuccess {
+		return &resp, errors.Errorf("SAML LogoutResponse returned non-success status %q", resp.Status.StatusCode.Value)
+	}
+	return &resp, nil
+}
+
+// parseLogoutRequest verifies raw's signature against sp.IDPCertificateStore, then parses an
+// IdP-initiated <samlp:LogoutRequest>. The signature check is mandatory, not optional: without it,
+// anyone who can guess or observe a user's NameID could force-terminate that user's session by
+// POSTing an unsigned LogoutRequest.
+func parseLogoutRequest(sp *saml2.SAMLServiceProvider, raw []byte) (*logoutRequestXML, error) {
+	verified, err := verifySLOSignature(sp, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var req logoutRequestXML
+	if err := xml.Unmarshal(verified, &req); err != nil {
+		return nil, errors.WithMessage(err, "parsing SAML LogoutRequest")
+	}
+	if req.NameID.Value == "" {
+		return nil, errors.New("SAML LogoutRequest has no NameID")
+	}
+	return &req, nil
+}
+
+// decodeRedirectBindingParam reverses redirectBindingURL's encoding of an HTTP-Redirect-bound
+// SAMLRequest/SAMLResponse query parameter.
+func decodeRedirectBindingParam(v string) ([]byte, error) {
+	deflated, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, errors.WithMessage(err, "base64-decoding SAML redirect binding parameter")
+	}
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+}
+
+// decodePOSTBindingParam reverses postBindingForm's encoding of an HTTP-POST-bound
+// SAMLRequest/SAMLResponse form parameter.
+func decodePOSTBindingParam(v string) ([]byte, error) {
+	bs, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, errors.WithMessage(err, "base64-decoding SAML POST binding parameter")
+	}
+	return bs, nil
+}
+
+// InitiateLogout builds the redirect URL (HTTP-Redirect binding) or self-submitting HTML form
+// (HTTP-POST binding) that starts an SP-initiated SAML Single Logout for nameID/sessionIndex,
+// using whichever binding the IdP's SingleLogoutService metadata prefers.
+//
+// WIP: not yet called from any logout UI action in this checkout; see the WIP comment below this
+// file's imports.
+func InitiateLogout(ctx context.Context, pc *schema.SAMLAuthProvider, sp *saml2.SAMLServiceProvider, nameID PersistedNameID, sessionIndex, relayState string) (redirectURL string, formHTML string, err error) {
+	slo, err := singleLogoutServiceFor(ctx, pc)
+	if err != nil {
+		return "", "", err
+	}
+
+	el, err := buildLogoutRequest(sp, pc.SignLogoutRequests, nameID, sessionIndex)
+	if err != nil {
+		return "", "", err
+	}
+
+	if slo.Binding == bindingHTTPPOST {
+		formHTML, err = postBindingForm(slo.Location, "SAMLRequest", el, relayState)
+		return "", formHTML, err
+	}
+	redirectURL, err = redirectBindingURL(slo.Location, "SAMLRequest", el, relayState)
+	return redirectURL, "", err
+}
+
+// serveSLO is the handler for the /saml/slo ACS-equivalent endpoint. It handles:
+//   - an IdP-initiated <LogoutRequest> (terminates the local session and replies with a
+//     <LogoutResponse>, signed if signLogoutRequests, over the same binding it arrived on), and
+//   - the IdP's <LogoutResponse> to a logout we initiated (verifies it and writes a plain
+//     "You have been logged out." message; RelayState is not followed).
+//
+// destination is the IdP's SingleLogoutService location (from singleLogoutServiceFor), used when
+// replying to an IdP-initiated LogoutRequest. terminateSession is provided by the caller because
+// local session storage lives outside the saml package.
+//
+// WIP: not yet registered as a handler for any route in this checkout; see the WIP comment below
+// this file's imports.
+func serveSLO(sp *saml2.SAMLServiceProvider, signLogoutRequests bool, destination string, terminateSession func(nameID string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var raw []byte
+		var err error
+		var relayState string
+
+		switch r.Method {
+		case http.MethodGet:
+			relayState = r.URL.Query().Get("RelayState")
+			if v := r.URL.Query().Get("SAMLRequest"); v != "" {
+				raw, err = decodeRedirectBindingParam(v)
+			} else if v := r.URL.Query().Get("SAMLResponse"); v != "" {
+				raw, err = decodeRedirectBindingParam(v)
+			}
+		case http.MethodPost:
+			if err = r.ParseForm(); err == nil {
+				relayState = r.PostForm.Get("RelayState")
+				if v := r.PostForm.Get("SAMLRequest"); v != "" {
+					raw, err = decodePOSTBindingParam(v)
+				} else if v := r.PostForm.Get("SAMLResponse"); v != "" {
+					raw, err = decodePOSTBindingParam(v)
+				}
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, errors.WithMessage(err, "decoding SAML SLO message").Error(), http.StatusBadRequest)
+			return
+		}
+		if raw == nil {
+			http.Error(w, "missing SAMLRequest or SAMLResponse parameter", http.StatusBadRequest)
+			return
+		}
+
+		if req, err := parseLogoutRequest(sp, raw); err == nil {
+			if err := terminateSession(req.NameID.Value); err != nil {
+				http.Error(w, errors.WithMessage(err, "terminating local session").Error(), http.StatusInternalServerError)
+				return
+			}
+			respEl, err := buildLogoutResponse(sp, signLogoutRequests, req.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeSLOResponse(w, r, destination, respEl, relayState)
+			return
+		}
+
+		if _, err := parseLogoutResponse(sp, raw); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, "You have been logged out.")
+	}
+}
+
+// writeSLOResponse replies to the IdP on the same binding the request arrived on: HTTP-POST
+// requests get a self-submitting form back (since the destination is the IdP, not a redirect the
+// browser can follow on a GET), and HTTP-Redirect (GET) requests get a 302 to the IdP.
+func writeSLOResponse(w http.ResponseWriter, r *http.Request, destination string, respEl *etree.Element, relayState string) {
+	if r.Method == http.MethodPost {
+		form, err := postBindingForm(destination, "SAMLResponse", respEl, relayState)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, form)
+		return
+	}
+
+	redirectURL, err := redirectBindingURL(destination, "SAMLResponse", respEl, relayState)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
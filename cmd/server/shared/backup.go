@@ -0,0 +1,439 @@
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Environment variables that configure the scheduled backup/restore subsystem for the internal
+// Postgres. All are optional; if PG_BACKUPS is unset the subsystem does nothing.
+const (
+	envBackupsEnabled    = "PG_BACKUPS"             // "true" to enable scheduled backups
+	envBackupInterval    = "PG_BACKUPS_INTERVAL"    // e.g. "24h" (default "24h")
+	envBackupDestination = "PG_BACKUPS_DESTINATION" // e.g. "file:///backups", "s3://bucket/prefix", "gs://bucket/prefix"
+	envBackupKeep        = "PG_BACKUPS_KEEP"        // number of most-recent backups to retain (default 7)
+)
+
+const backupStatusFileName = ".backup-restore-status"
+
+// backupConfig holds the scheduled backup/restore settings read from the environment.
+type backupConfig struct {
+	interval time.Duration
+	keep     int
+	dest     backupDestination
+}
+
+// backupConfigFromEnv reads the PG_BACKUPS* environment variables. ok is false (with a nil error)
+// if backups are not enabled, in which case the caller should treat the subsystem as absent.
+func backupConfigFromEnv() (cfg *backupConfig, ok bool, err error) {
+	if os.Getenv(envBackupsEnabled) != "true" {
+		return nil, false, nil
+	}
+
+	interval := 24 * time.Hour
+	if v := os.Getenv(envBackupInterval); v != "" {
+		interval, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "invalid %s", envBackupInterval)
+		}
+	}
+
+	keep := 7
+	if v := os.Getenv(envBackupKeep); v != "" {
+		keep, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "invalid %s", envBackupKeep)
+		}
+	}
+
+	destURL := os.Getenv(envBackupDestination)
+	if destURL == "" {
+		return nil, false, errors.Errorf("%s must be set when %s is enabled", envBackupDestination, envBackupsEnabled)
+	}
+	dest, err := newBackupDestination(destURL)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "invalid %s", envBackupDestination)
+	}
+
+	return &backupConfig{interval: interval, keep: keep, dest: dest}, true, nil
+}
+
+// backupDestination abstracts the storage location that backups are written to and restored
+// from, so Backup and Restore don't need to know whether backups live on local disk, S3 or GCS.
+type backupDestination interface {
+	// Put uploads the contents of r to name.
+	Put(ctx context.Context, name string, r io.Reader) error
+	// Get opens name for reading. It returns os.ErrNotExist if name does not exist.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names of all backups at the destination, oldest first.
+	List(ctx context.Context) ([]string, error)
+	// Delete removes name from the destination.
+	Delete(ctx context.Context, name string) error
+}
+
+// newBackupDestination parses a destination URL of the form file://, s3:// or gs:// and returns
+// the corresponding backupDestination.
+func newBackupDestination(destURL string) (backupDestination, error) {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file", "":
+		return &fileBackupDestination{dir: path.Join(u.Host, u.Path)}, nil
+	case "s3":
+		return newS3BackupDestination(u)
+	case "gs":
+		return newGCSBackupDestination(u)
+	default:
+		return nil, errors.Errorf("unsupported backup destination scheme %q (want file, s3 or gs)", u.Scheme)
+	}
+}
+
+// backupNamePrefix and the "20060102T150405Z" timestamp layout together produce lexically
+// sortable backup names, so List (oldest first) is just a string sort.
+const backupNamePrefix = "pg-backup-"
+const backupTimeLayout = "20060102T150405Z"
+
+func backupName(t time.Time) string {
+	return backupNamePrefix + t.UTC().Format(backupTimeLayout) + ".sql.gz"
+}
+
+// Backup takes a logical backup (pg_dumpall) of the running local Postgres, compresses it, and
+// writes it to the configured destination, rotating old backups so that only the most recent
+// PG_BACKUPS_KEEP are kept.
+func Backup(ctx context.Context) error {
+	cfg, ok, err := backupConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("backups are not enabled (set " + envBackupsEnabled + ")")
+	}
+
+	tmp, err := ioutil.TempFile("", "pg-backup-*.sql.gz")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp file for backup")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gzw := gzip.NewWriter(tmp)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "su-exec", "postgres", "pg_dumpall", "--clean", "--if-exists")
+	cmd.Stdout = gzw
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("pg_dumpall failed:\n%s", stderr.String())
+		return errors.Wrap(err, "pg_dumpall failed")
+	}
+	if err := gzw.Close(); err != nil {
+		return errors.Wrap(err, "failed to finalize backup archive")
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "failed to rewind backup archive")
+	}
+
+	name := backupName(time.Now())
+	if err := cfg.dest.Put(ctx, name, tmp); err != nil {
+		return errors.Wrapf(err, "failed to upload backup %q", name)
+	}
+
+	if err := rotateBackups(ctx, cfg); err != nil {
+		log.Printf("✱ Failed to rotate old backups (the new backup %q was still taken successfully): %s", name, err)
+	}
+
+	return nil
+}
+
+// rotateBackups deletes all but the cfg.keep most-recent backups at the destination.
+func rotateBackups(ctx context.Context, cfg *backupConfig) error {
+	if cfg.keep <= 0 {
+		return nil
+	}
+	names, err := cfg.dest.List(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	if len(names) <= cfg.keep {
+		return nil
+	}
+	for _, name := range names[:len(names)-cfg.keep] {
+		if err := cfg.dest.Delete(ctx, name); err != nil {
+			return errors.Wrapf(err, "failed to delete old backup %q", name)
+		}
+	}
+	return nil
+}
+
+// latestBackup returns the name of the most recent backup at the destination, or "" if there are
+// none.
+func latestBackup(ctx context.Context, dest backupDestination) (string, error) {
+	names, err := dest.List(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	sort.Strings(names)
+	return names[len(names)-1], nil
+}
+
+// restoreScratchDir returns the scratch directory restoreInto populates before a caller of
+// maybeRestorePostgresFromBackup moves it into place at path. Mirroring maybeUpgradePostgres's
+// upgradeDir/rename dance this way means path itself is never touched until the restore has fully
+// succeeded, so a crash mid-restore can't leave a half-restored cluster sitting at path.
+func restoreScratchDir(path string) string {
+	return path + ".restoring"
+}
+
+// maybeRestorePostgresFromBackup restores the most recent backup into path if path is empty (i.e.
+// this is a brand-new data dir) and backups are enabled and a valid backup exists. It mirrors the
+// status-file dance used by maybeUpgradePostgres so that an interrupted restore is detected and
+// reported on the next boot instead of silently leaving a half-restored cluster in place.
+func maybeRestorePostgresFromBackup(ctx context.Context, path string) (restored bool, err error) {
+	cfg, ok, err := backupConfigFromEnv()
+	if err != nil || !ok {
+		return false, err
+	}
+
+	name, err := latestBackup(ctx, cfg.dest)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to list backups")
+	}
+	if name == "" {
+		return false, nil
+	}
+
+	statusFile := filepath.Join(filepath.Dir(path), backupStatusFileName)
+	if bs, err := ioutil.ReadFile(statusFile); err != nil && !os.IsNotExist(err) {
+		return false, errors.Wrap(err, "failed to read backup status file")
+	} else if strings.TrimSpace(string(bs)) == "started" {
+		return false, errors.New("Sourcegraph was previously interrupted while restoring its internal database from a backup; " +
+			"remove " + restoreScratchDir(path) + " and " + statusFile + " and restart to try again, or restore from a known-good backup manually")
+	}
+
+	log.Printf("✱ Sourcegraph is restoring its internal database from backup %q", name)
+	if err := ioutil.WriteFile(statusFile, []byte("started"), 0755); err != nil {
+		return false, errors.Wrap(err, "failed to create backup status file")
+	}
+
+	// Restore into a scratch directory, not path itself: path must stay absent until the restore
+	// is verified complete, otherwise maybePostgresProcFile's os.Stat(path) check on the next boot
+	// would find a pre-existing (but half-restored) data dir and skip this function entirely,
+	// never noticing the "started" status file left behind by an interrupted restore.
+	scratchDir := restoreScratchDir(path)
+	if err := os.RemoveAll(scratchDir); err != nil {
+		return false, errors.Wrap(err, "failed to clean up previous restore scratch dir")
+	}
+	if err := restoreInto(ctx, cfg.dest, name, scratchDir); err != nil {
+		return false, errors.Wrapf(err, "failed to restore backup %q", name)
+	}
+	if err := os.Rename(scratchDir, path); err != nil {
+		return false, errors.Wrap(err, "failed to move restored database into place")
+	}
+
+	if err := ioutil.WriteFile(statusFile, []byte("done"), 0755); err != nil {
+		return false, errors.Wrap(err, "failed to update backup status file")
+	}
+	return true, nil
+}
+
+// Restore restores the most recent backup at the configured destination over the current
+// Postgres data directory. It is intended to be invoked on demand (e.g. from an admin endpoint)
+// while Sourcegraph is up: it stops the running local Postgres, restores the backup into a
+// scratch directory (so the current data dir is left untouched until the restore has succeeded),
+// swaps the restored data into place, and starts Postgres back up. During normal container startup,
+// restoration of an empty data dir is instead handled transparently by
+// maybeRestorePostgresFromBackup.
+func Restore(ctx context.Context) error {
+	cfg, ok, err := backupConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("backups are not enabled (set " + envBackupsEnabled + ")")
+	}
+
+	name, err := latestBackup(ctx, cfg.dest)
+	if err != nil {
+		return errors.Wrap(err, "failed to list backups")
+	}
+	if name == "" {
+		return errors.New("no backups found at destination")
+	}
+
+	path := filepath.Join(os.Getenv("DATA_DIR"), "postgresql")
+
+	var output bytes.Buffer
+	stop := execer{Out: &output}
+	stop.Command("su-exec", "postgres", "pg_ctl", "-D", path, "-m", "fast", "-w", "stop")
+	if err := stop.Error(); err != nil {
+		log.Printf("Stopping running postgres before restore failed:\n%s", output.String())
+		return errors.Wrap(err, "failed to stop running postgres before restore")
+	}
+
+	scratchDir := restoreScratchDir(path)
+	if err := os.RemoveAll(scratchDir); err != nil {
+		return errors.Wrap(err, "failed to clean up previous restore scratch dir")
+	}
+	if err := restoreInto(ctx, cfg.dest, name, scratchDir); err != nil {
+		return errors.Wrapf(err, "failed to restore backup %q", name)
+	}
+
+	bak := path + ".pre-restore-" + time.Now().UTC().Format(backupTimeLayout) + ".bak"
+	swap := execer{Out: &output}
+	swap.Command("mv", path, bak)
+	swap.Command("mv", scratchDir, path)
+	swap.Command("chown", "-R", "postgres", path)
+	if err := swap.Error(); err != nil {
+		log.Printf("Swapping in restored database failed:\n%s", output.String())
+		return errors.Wrap(err, "failed to move restored database into place")
+	}
+
+	start := execer{Out: &output}
+	start.Command("su-exec", "postgres", "pg_ctl", "-D", path, "-o -c listen_addresses=127.0.0.1", "-l", "/tmp/pgsql.log", "-w", "start")
+	if err := start.Error(); err != nil {
+		log.Printf("Restarting postgres after restore failed:\n%s", output.String())
+		return errors.Wrap(err, "failed to restart postgres after restore")
+	}
+	return nil
+}
+
+// restoreInto initdb's a fresh cluster at targetDir, which must not already exist, starts it, and
+// replays the pg_dumpall archive named name from dest into it, then stops it again. Callers are
+// responsible for moving targetDir into place only once this returns successfully.
+func restoreInto(ctx context.Context, dest backupDestination, name, targetDir string) error {
+	r, err := dest.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to decompress backup archive")
+	}
+	defer gzr.Close()
+
+	var output bytes.Buffer
+	e := execer{Out: &output}
+	e.Command("mkdir", "-p", targetDir)
+	e.Command("chown", "postgres", targetDir)
+	e.Command("su-exec", "postgres", "initdb", "-D", targetDir, "--nosync")
+	e.Command("su-exec", "postgres", "pg_ctl", "-D", targetDir, "-o -c listen_addresses=127.0.0.1", "-l", "/tmp/pgsql-restore.log", "-w", "start")
+	if err := e.Error(); err != nil {
+		log.Printf("Preparing restore target failed:\n%s", output.String())
+		return err
+	}
+
+	var stderr bytes.Buffer
+	psql := exec.CommandContext(ctx, "su-exec", "postgres", "psql", "-v", "ON_ERROR_STOP=0", "--quiet")
+	psql.Stdin = gzr
+	psql.Stderr = &stderr
+	if err := psql.Run(); err != nil {
+		log.Printf("Restoring from backup failed:\n%s", stderr.String())
+		return errors.Wrap(err, "psql restore failed")
+	}
+
+	stop := execer{Out: &output}
+	stop.Command("su-exec", "postgres", "pg_ctl", "-D", targetDir, "-m", "fast", "-l", "/tmp/pgsql-restore.log", "-w", "stop")
+	if err := stop.Error(); err != nil {
+		log.Printf("Stopping restore target failed:\n%s", output.String())
+		return err
+	}
+	return nil
+}
+
+// RunScheduler blocks, running Backup on the interval configured by PG_BACKUPS_INTERVAL, until
+// ctx is done. Failed backups are logged but do not stop the scheduler, since a transient failure
+// (e.g. a network blip talking to S3) shouldn't prevent future attempts.
+func RunScheduler(ctx context.Context) {
+	cfg, ok, err := backupConfigFromEnv()
+	if err != nil {
+		log.Printf("✱ Not running scheduled backups: %s", err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	log.Printf("✱ Scheduled backups of the internal database are enabled (every %s)", cfg.interval)
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := Backup(ctx); err != nil {
+				log.Printf("✱ Scheduled backup failed: %s", err)
+			}
+		}
+	}
+}
+
+// fileBackupDestination stores backups on local disk, e.g. a mounted volume.
+type fileBackupDestination struct{ dir string }
+
+func (d *fileBackupDestination) Put(ctx context.Context, name string, r io.Reader) error {
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(d.dir, "."+name+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(d.dir, name))
+}
+
+func (d *fileBackupDestination) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.dir, name))
+}
+
+func (d *fileBackupDestination) List(ctx context.Context) ([]string, error) {
+	entries, err := ioutil.ReadDir(d.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), backupNamePrefix) {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d *fileBackupDestination) Delete(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(d.dir, name))
+}
@@ -0,0 +1,138 @@
+package shared
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+)
+
+// s3BackupDestination stores backups in an S3 bucket, e.g. s3://my-bucket/sourcegraph/backups.
+type s3BackupDestination struct {
+	bucket string
+	prefix string
+	client *s3.S3
+}
+
+func newS3BackupDestination(u *url.URL) (*s3BackupDestination, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AWS session")
+	}
+	return &s3BackupDestination{
+		bucket: u.Host,
+		prefix: strings.TrimPrefix(u.Path, "/"),
+		client: s3.New(sess),
+	}, nil
+}
+
+func (d *s3BackupDestination) key(name string) string {
+	return strings.TrimSuffix(d.prefix+"/"+name, "/")
+}
+
+func (d *s3BackupDestination) Put(ctx context.Context, name string, r io.Reader) error {
+	uploader := s3manager.NewUploaderWithClient(d.client)
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.key(name)),
+		Body:   r,
+	})
+	return err
+}
+
+func (d *s3BackupDestination) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	out, err := d.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.key(name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (d *s3BackupDestination) List(ctx context.Context) ([]string, error) {
+	var names []string
+	err := d.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(d.bucket),
+		Prefix: aws.String(d.prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			names = append(names, strings.TrimPrefix(strings.TrimPrefix(aws.StringValue(obj.Key), d.prefix), "/"))
+		}
+		return true
+	})
+	return names, err
+}
+
+func (d *s3BackupDestination) Delete(ctx context.Context, name string) error {
+	_, err := d.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.key(name)),
+	})
+	return err
+}
+
+// gcsBackupDestination stores backups in a GCS bucket, e.g. gs://my-bucket/sourcegraph/backups.
+type gcsBackupDestination struct {
+	bucket string
+	prefix string
+	client *storage.Client
+}
+
+func newGCSBackupDestination(u *url.URL) (*gcsBackupDestination, error) {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create GCS client")
+	}
+	return &gcsBackupDestination{
+		bucket: u.Host,
+		prefix: strings.TrimPrefix(u.Path, "/"),
+		client: client,
+	}, nil
+}
+
+func (d *gcsBackupDestination) object(name string) *storage.ObjectHandle {
+	return d.client.Bucket(d.bucket).Object(strings.TrimSuffix(d.prefix+"/"+name, "/"))
+}
+
+func (d *gcsBackupDestination) Put(ctx context.Context, name string, r io.Reader) error {
+	w := d.object(name).NewWriter(ctx)
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (d *gcsBackupDestination) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return d.object(name).NewReader(ctx)
+}
+
+func (d *gcsBackupDestination) List(ctx context.Context) ([]string, error) {
+	var names []string
+	it := d.client.Bucket(d.bucket).Objects(ctx, &storage.Query{Prefix: d.prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return names, err
+		}
+		names = append(names, strings.TrimPrefix(strings.TrimPrefix(attrs.Name, d.prefix), "/"))
+	}
+	return names, nil
+}
+
+func (d *gcsBackupDestination) Delete(ctx context.Context, name string) error {
+	return d.object(name).Delete(ctx)
+}
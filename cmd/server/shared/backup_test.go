@@ -0,0 +1,155 @@
+package shared
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+// memBackupDestination is an in-memory backupDestination for exercising rotation/listing logic
+// without touching disk.
+type memBackupDestination struct {
+	names map[string]bool
+}
+
+func (d *memBackupDestination) Put(ctx context.Context, name string, r io.Reader) error {
+	if d.names == nil {
+		d.names = map[string]bool{}
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		return err
+	}
+	d.names[name] = true
+	return nil
+}
+
+func (d *memBackupDestination) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if !d.names[name] {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(nil), nil
+}
+
+func (d *memBackupDestination) List(ctx context.Context) ([]string, error) {
+	names := make([]string, 0, len(d.names))
+	for name := range d.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *memBackupDestination) Delete(ctx context.Context, name string) error {
+	delete(d.names, name)
+	return nil
+}
+
+func withEnv(t *testing.T, kvs map[string]string) {
+	t.Helper()
+	for k, v := range kvs {
+		old, had := os.LookupEnv(k)
+		if v == "" {
+			os.Unsetenv(k)
+		} else {
+			os.Setenv(k, v)
+		}
+		t.Cleanup(func() {
+			if had {
+				os.Setenv(k, old)
+			} else {
+				os.Unsetenv(k)
+			}
+		})
+	}
+}
+
+func TestBackupConfigFromEnv_disabled(t *testing.T) {
+	for _, v := range []string{"", "false", "1", "yes"} {
+		withEnv(t, map[string]string{envBackupsEnabled: v})
+		cfg, ok, err := backupConfigFromEnv()
+		if err != nil || ok || cfg != nil {
+			t.Errorf("%s=%q: got cfg=%v ok=%v err=%v, want disabled", envBackupsEnabled, v, cfg, ok, err)
+		}
+	}
+}
+
+func TestBackupConfigFromEnv_enabled(t *testing.T) {
+	withEnv(t, map[string]string{
+		envBackupsEnabled:    "true",
+		envBackupInterval:    "1h",
+		envBackupKeep:        "3",
+		envBackupDestination: "file:///tmp/backups",
+	})
+	cfg, ok, err := backupConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("want enabled")
+	}
+	if cfg.interval != time.Hour {
+		t.Errorf("interval = %s, want 1h", cfg.interval)
+	}
+	if cfg.keep != 3 {
+		t.Errorf("keep = %d, want 3", cfg.keep)
+	}
+}
+
+func TestBackupConfigFromEnv_missingDestination(t *testing.T) {
+	withEnv(t, map[string]string{envBackupsEnabled: "true", envBackupDestination: ""})
+	if _, ok, err := backupConfigFromEnv(); err == nil || ok {
+		t.Errorf("want error when %s is unset", envBackupDestination)
+	}
+}
+
+func TestRotateBackups(t *testing.T) {
+	dest := &memBackupDestination{names: map[string]bool{}}
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		dest.names[backupName(base.Add(time.Duration(i)*time.Hour))] = true
+	}
+
+	if err := rotateBackups(context.Background(), &backupConfig{keep: 2, dest: dest}); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := dest.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("got %d backups after rotation, want 2: %v", len(names), names)
+	}
+	want := []string{backupName(base.Add(3 * time.Hour)), backupName(base.Add(4 * time.Hour))}
+	sort.Strings(want)
+	for i, name := range names {
+		if name != want[i] {
+			t.Errorf("names[%d] = %q, want %q", i, name, want[i])
+		}
+	}
+}
+
+func TestLatestBackup(t *testing.T) {
+	dest := &memBackupDestination{names: map[string]bool{}}
+	if name, err := latestBackup(context.Background(), dest); err != nil || name != "" {
+		t.Errorf("latestBackup on empty destination = (%q, %v), want (\"\", nil)", name, err)
+	}
+
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	oldest := backupName(base)
+	newest := backupName(base.Add(24 * time.Hour))
+	dest.names[oldest] = true
+	dest.names[newest] = true
+
+	name, err := latestBackup(context.Background(), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != newest {
+		t.Errorf("latestBackup = %q, want %q", name, newest)
+	}
+}
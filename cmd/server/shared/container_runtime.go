@@ -0,0 +1,150 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+// containerRuntime abstracts the container engine used to run one-off upgrade containers (e.g.
+// tianon/postgres-upgrade in maybeUpgradePostgres), so that the upgrade flow works the same
+// whether the host is running Docker or rootless Podman.
+type containerRuntime interface {
+	// PullImage pulls img, writing pull progress to out.
+	PullImage(ctx context.Context, img string, out io.Writer) error
+
+	// RunOnce creates and starts a container named name from cfg/hostCfg, waits for it to exit,
+	// and returns its combined stdout/stderr logs and exit code.
+	RunOnce(ctx context.Context, cfg *container.Config, hostCfg *container.HostConfig, name string) (logs io.Reader, exitCode int64, err error)
+
+	// HostMountPoint finds the host path bind-mounted (or mounted) at path inside the container
+	// identified by id.
+	HostMountPoint(ctx context.Context, id, path string) (string, error)
+}
+
+// newContainerRuntime probes for a reachable container engine and returns the containerRuntime
+// that talks to it. It prefers whatever CONTAINER_HOST or DOCKER_HOST point at; if neither is
+// set, it looks for a rootless Podman socket under XDG_RUNTIME_DIR before falling back to the
+// default Docker socket.
+func newContainerRuntime() (containerRuntime, error) {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return newRuntimeForHost(host)
+	}
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		return newRuntimeForHost(host)
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		podmanSock := filepath.Join(runtimeDir, "podman", "podman.sock")
+		if _, err := os.Stat(podmanSock); err == nil {
+			return newPodmanRuntime("unix://" + podmanSock)
+		}
+	}
+	return newDockerRuntime("")
+}
+
+// newRuntimeForHost picks a runtime implementation based on a CONTAINER_HOST/DOCKER_HOST value,
+// treating a socket path that mentions "podman" as the Podman-compatible API.
+func newRuntimeForHost(host string) (containerRuntime, error) {
+	if u, err := url.Parse(host); err == nil && strings.Contains(u.Path, "podman") {
+		return newPodmanRuntime(host)
+	}
+	return newDockerRuntime(host)
+}
+
+// dockerRuntime implements containerRuntime against a real Docker daemon.
+type dockerRuntime struct{ cli *docker.Client }
+
+func newDockerRuntime(host string) (*dockerRuntime, error) {
+	// Use a fairly old Docker API version for maximum compatibility.
+	opts := []client.Opt{client.FromEnv, client.WithVersion("1.28")}
+	if host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	cli, err := docker.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialise docker client")
+	}
+	return &dockerRuntime{cli: cli}, nil
+}
+
+func (r *dockerRuntime) PullImage(ctx context.Context, img string, out io.Writer) error {
+	rc, err := r.cli.ImagePull(ctx, img, types.ImagePullOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to pull %q", img)
+	}
+	defer rc.Close()
+	if _, err := io.Copy(out, rc); err != nil {
+		return errors.Wrap(err, "failed to read output of docker pull")
+	}
+	return nil
+}
+
+func (r *dockerRuntime) RunOnce(ctx context.Context, cfg *container.Config, hostCfg *container.HostConfig, name string) (io.Reader, int64, error) {
+	resp, err := r.cli.ContainerCreate(ctx, cfg, hostCfg, nil, name)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to create %q", name)
+	}
+
+	if err := r.cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to start %q", name)
+	}
+
+	var exitCode int64
+	statusch, errch := r.cli.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errch:
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "failed to wait for container")
+		}
+	case status := <-statusch:
+		exitCode = status.StatusCode
+	}
+
+	rawLogs, err := r.cli.ContainerLogs(ctx, resp.ID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return nil, exitCode, errors.Wrapf(err, "failed to retrieve %q logs", name)
+	}
+
+	// The container isn't allocated a TTY, so ContainerLogs multiplexes stdout/stderr together
+	// with 8-byte frame headers (see stdcopy.StdCopy); demultiplex it here so callers get a plain
+	// text stream instead of binary frame headers interleaved with the logs.
+	pr, pw := io.Pipe()
+	go func() {
+		defer rawLogs.Close()
+		_, copyErr := stdcopy.StdCopy(pw, pw, rawLogs)
+		pw.CloseWithError(copyErr)
+	}()
+	return pr, exitCode, nil
+}
+
+func (r *dockerRuntime) HostMountPoint(ctx context.Context, id, path string) (string, error) {
+	c, err := r.cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to inspect container %q", id)
+	}
+
+	for _, bind := range c.HostConfig.Binds {
+		if ps := strings.SplitN(bind, ":", 2); len(ps) == 2 && ps[1] == path {
+			return ps[0], nil
+		}
+	}
+
+	for _, mount := range c.Mounts {
+		if mount.Destination == path {
+			return mount.Source, nil
+		}
+	}
+
+	return "", fmt.Errorf("couldn't find host mountpoint of %q on container %q", path, id)
+}
@@ -0,0 +1,25 @@
+package shared
+
+import (
+	"github.com/docker/docker/client"
+	docker "github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// podmanRuntime implements containerRuntime against Podman's Docker-compatible REST API, exposed
+// over a unix socket (typically $XDG_RUNTIME_DIR/podman/podman.sock for rootless Podman). It
+// embeds a dockerRuntime because the wire protocol is the same, differing only in how the client
+// is constructed: Podman's compatibility layer does not always negotiate the same API version
+// numbers as a real Docker daemon, so pinning a version the way dockerRuntime does would cause
+// every request to fail version negotiation.
+type podmanRuntime struct {
+	*dockerRuntime
+}
+
+func newPodmanRuntime(host string) (*podmanRuntime, error) {
+	cli, err := docker.NewClientWithOpts(client.WithHost(host), client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialise podman client")
+	}
+	return &podmanRuntime{dockerRuntime: &dockerRuntime{cli: cli}}, nil
+}
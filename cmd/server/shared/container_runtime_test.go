@@ -0,0 +1,27 @@
+package shared
+
+import "testing"
+
+func TestNewRuntimeForHost(t *testing.T) {
+	tests := []struct {
+		host       string
+		wantPodman bool
+	}{
+		{host: "unix:///run/user/1000/podman/podman.sock", wantPodman: true},
+		{host: "unix:///var/run/docker.sock", wantPodman: false},
+		{host: "tcp://127.0.0.1:2375", wantPodman: false},
+		{host: "unix:///run/podman/podman.sock", wantPodman: true},
+	}
+
+	for _, tt := range tests {
+		rt, err := newRuntimeForHost(tt.host)
+		if err != nil {
+			t.Errorf("newRuntimeForHost(%q): %s", tt.host, err)
+			continue
+		}
+		_, isPodman := rt.(*podmanRuntime)
+		if isPodman != tt.wantPodman {
+			t.Errorf("newRuntimeForHost(%q) = %T, want podman=%v", tt.host, rt, tt.wantPodman)
+		}
+	}
+}
@@ -13,11 +13,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
-	docker "github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/pkg/errors"
 )
 
@@ -45,25 +41,32 @@ func maybePostgresProcFile() (string, error) {
 			return "", err
 		}
 
-		if verbose {
-			log.Printf("Setting up PostgreSQL at %s", path)
+		restored, err := maybeRestorePostgresFromBackup(context.Background(), path)
+		if err != nil {
+			return "", err
 		}
-		log.Println("✱ Sourcegraph is initializing the internal database... (may take 15-20 seconds)")
 
-		var output bytes.Buffer
-		e := execer{Out: &output}
-		e.Command("mkdir", "-p", path)
-		e.Command("chown", "postgres", path)
-		// initdb --nosync saves ~3-15s on macOS during initial startup. By the time actual data lives in the
-		// DB, the OS should have had time to fsync.
-		e.Command("su-exec", "postgres", "initdb", "-D", path, "--nosync")
-		e.Command("su-exec", "postgres", "pg_ctl", "-D", path, "-o -c listen_addresses=127.0.0.1", "-l", "/tmp/pgsql.log", "-w", "start")
-		e.Command("su-exec", "postgres", "createdb", "sourcegraph")
-		e.Command("su-exec", "postgres", "pg_ctl", "-D", path, "-m", "fast", "-l", "/tmp/pgsql.log", "-w", "stop")
-		if err := e.Error(); err != nil {
-			log.Printf("Setting up postgres failed:\n%s", output.String())
-			os.RemoveAll(path)
-			return "", err
+		if !restored {
+			if verbose {
+				log.Printf("Setting up PostgreSQL at %s", path)
+			}
+			log.Println("✱ Sourcegraph is initializing the internal database... (may take 15-20 seconds)")
+
+			var output bytes.Buffer
+			e := execer{Out: &output}
+			e.Command("mkdir", "-p", path)
+			e.Command("chown", "postgres", path)
+			// initdb --nosync saves ~3-15s on macOS during initial startup. By the time actual data lives in the
+			// DB, the OS should have had time to fsync.
+			e.Command("su-exec", "postgres", "initdb", "-D", path, "--nosync")
+			e.Command("su-exec", "postgres", "pg_ctl", "-D", path, "-o -c listen_addresses=127.0.0.1", "-l", "/tmp/pgsql.log", "-w", "start")
+			e.Command("su-exec", "postgres", "createdb", "sourcegraph")
+			e.Command("su-exec", "postgres", "pg_ctl", "-D", path, "-m", "fast", "-l", "/tmp/pgsql.log", "-w", "stop")
+			if err := e.Error(); err != nil {
+				log.Printf("Setting up postgres failed:\n%s", output.String())
+				os.RemoveAll(path)
+				return "", err
+			}
 		}
 	} else {
 		// Between restarts the owner of the volume may have changed. Ensure
@@ -98,33 +101,16 @@ func maybePostgresProcFile() (string, error) {
 }
 
 // maybeUpgradePostgres upgrades the Postgres data files in path to the given version
-// if they're not already upgraded. It requires access to the host's Docker socket.
+// if they're not already upgraded. The image strategy requires access to the host's Docker (or
+// Podman) socket; the logical strategy does not.
 func maybeUpgradePostgres(path, newVersion string) error {
 	bs, err := ioutil.ReadFile(filepath.Join(path, "PG_VERSION"))
 	if err != nil {
 		return errors.Wrap(err, "failed to detect version of existing Postgres data")
 	}
-
-	id, err := containerID()
-	if err != nil {
-		return errors.Wrap(err, "failed to determine running container id")
-	}
-
-	// Use a fairly old Docker version for maximum compatibility.
-	cli, err := docker.NewClientWithOpts(client.FromEnv, client.WithVersion("1.28"))
-	if err != nil {
-		return errors.Wrap(err, "failed to initialise docker client")
-	}
-
-	ctx := context.Background()
-	hostDataDir, err := hostMountPoint(ctx, cli, id, filepath.Dir(path))
-	if err != nil {
-		return errors.Wrap(err, "failed to determine host mount point")
-	}
-
 	oldVersion := strings.TrimSpace(string(bs))
+
 	upgradeDir := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s-to-%s-upgrade", oldVersion, newVersion))
-	hostUpgradeDir := filepath.Join(hostDataDir, filepath.Base(upgradeDir))
 	statusFile := filepath.Join(upgradeDir, "status")
 
 	if err := os.MkdirAll(upgradeDir, 0755); err != nil {
@@ -133,25 +119,38 @@ func maybeUpgradePostgres(path, newVersion string) error {
 		return errors.Wrap(err, "failed to read status file")
 	}
 
-	// e.g: ~/.sourcegraph/data/postgresql
-	hostPath := filepath.Join(hostDataDir, filepath.Base(path))
+	// pgUpgradeStrategyFor is decided before anything Docker-related runs: the whole point of
+	// pgUpgradeStrategyLogical is to work on a host with no Docker/Podman socket at all, so
+	// hostUpgradePaths (which needs one) must only be called for pgUpgradeStrategyImage.
+	strategy := pgUpgradeStrategyFor(oldVersion, newVersion)
+	ctx := context.Background()
+
 	status := string(bytes.TrimSpace(bs)) // possible values: "", "started", "done"
 	if status == "started" {
 		log.Printf("✱ Sourcegraph was previously interrupted while upgrading its internal database.")
-		log.Printf("✱ To try again, start the container after running these commands (safe):\n")
-		if oldVersion == newVersion {
-			log.Printf(
-				"$ mv %s %s\n$ mv %s %s\n$ rm -rf %s",
-				hostPath, hostPath+"-"+newVersion+".bak",
-				hostPath+"-"+oldVersion, hostPath,
-				hostUpgradeDir,
-			)
+		if strategy == pgUpgradeStrategyImage {
+			_, hostUpgradeDir, hostPath, err := hostUpgradePaths(ctx, path, upgradeDir)
+			if err != nil {
+				return err
+			}
+			log.Printf("✱ To try again, start the container after running these commands (safe):\n")
+			if oldVersion == newVersion {
+				log.Printf(
+					"$ mv %s %s\n$ mv %s %s\n$ rm -rf %s",
+					hostPath, hostPath+"-"+newVersion+".bak",
+					hostPath+"-"+oldVersion, hostPath,
+					hostUpgradeDir,
+				)
+			} else {
+				log.Printf(
+					"$ mv %s %s\n$ rm -rf %s",
+					hostPath+"-"+newVersion, hostPath+"-"+newVersion+".bak",
+					hostUpgradeDir,
+				)
+			}
 		} else {
-			log.Printf(
-				"$ mv %s %s\n$ rm -rf %s",
-				hostPath+"-"+newVersion, hostPath+"-"+newVersion+".bak",
-				hostUpgradeDir,
-			)
+			log.Printf("✱ To try again, run these commands and restart (safe):\n")
+			log.Printf("$ rm -rf %s-%s %s", path, newVersion, upgradeDir)
 		}
 		return errors.New("Interrupted internal database upgrade detected")
 	}
@@ -174,53 +173,53 @@ func maybeUpgradePostgres(path, newVersion string) error {
 		output = &bytes.Buffer{}
 	}
 
-	img := fmt.Sprintf("tianon/postgres-upgrade:%s-to-%s", oldVersion, newVersion)
-
-	if out, err := cli.ImagePull(ctx, img, types.ImagePullOptions{}); err != nil {
-		return errors.Wrapf(err, "failed to pull %q", img)
-	} else if _, err = io.Copy(output, out); err != nil {
-		return errors.Wrap(err, "failed to read output of docker pull")
-	}
-
-	config := container.Config{Image: img, WorkingDir: "/tmp/upgrade"}
-	hostConfig := container.HostConfig{
-		Binds: []string{
-			// The *.sql and *.sh scripts generated by pg_upgrade will be stored in this directory
-			// so that we can access them in the current container when running /postgres-optimize.sh
-			// after pg_upgrade finished.
-			fmt.Sprintf("%s:%s", hostUpgradeDir, config.WorkingDir),
-			fmt.Sprintf("%s:/var/lib/postgresql/%s/data", hostPath, oldVersion),
-			fmt.Sprintf("%s-%s:/var/lib/postgresql/%s/data", hostPath, newVersion, newVersion),
-		},
-	}
-
-	now := time.Now()
-	name := fmt.Sprintf("sourcegraph-postgres-upgrade-%d", now.Unix())
-	resp, err := cli.ContainerCreate(ctx, &config, &hostConfig, nil, name)
-	if err != nil {
-		return errors.Wrapf(err, "failed to create %q", name)
-	}
-
-	if err = cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		return errors.Wrapf(err, "failed to start %q", name)
-	}
-
-	statusch, errch := cli.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
-	select {
-	case err := <-errch:
+	if strategy == pgUpgradeStrategyImage {
+		rt, hostUpgradeDir, hostPath, err := hostUpgradePaths(ctx, path, upgradeDir)
 		if err != nil {
-			return errors.Wrap(err, "failed to upgrade postgres")
+			return err
 		}
-	case <-statusch:
-	}
 
-	out, err := cli.ContainerLogs(ctx, resp.ID, types.ContainerLogsOptions{ShowStdout: true})
-	if err != nil {
-		return errors.Wrapf(err, "failed to retrieve %q logs", name)
+		img := fmt.Sprintf("tianon/postgres-upgrade:%s-to-%s", oldVersion, newVersion)
+
+		if err := rt.PullImage(ctx, img, output); err != nil {
+			if !isImagePullNotFoundErr(err) {
+				return err
+			}
+			log.Printf("✱ No %s image is published; falling back to a logical (pg_dumpall) upgrade.", img)
+			strategy = pgUpgradeStrategyLogical
+		} else {
+			config := container.Config{Image: img, WorkingDir: "/tmp/upgrade"}
+			hostConfig := container.HostConfig{
+				Binds: []string{
+					// The *.sql and *.sh scripts generated by pg_upgrade will be stored in this directory
+					// so that we can access them in the current container when running /postgres-optimize.sh
+					// after pg_upgrade finished.
+					fmt.Sprintf("%s:%s", hostUpgradeDir, config.WorkingDir),
+					fmt.Sprintf("%s:/var/lib/postgresql/%s/data", hostPath, oldVersion),
+					fmt.Sprintf("%s-%s:/var/lib/postgresql/%s/data", hostPath, newVersion, newVersion),
+				},
+			}
+
+			now := time.Now()
+			name := fmt.Sprintf("sourcegraph-postgres-upgrade-%d", now.Unix())
+			logs, _, err := rt.RunOnce(ctx, &config, &hostConfig, name)
+			if err != nil {
+				return errors.Wrap(err, "failed to upgrade postgres")
+			}
+
+			if _, err = io.Copy(output, logs); err != nil {
+				return errors.Wrap(err, "failed to copy logs to output")
+			}
+		}
 	}
 
-	if _, err = stdcopy.StdCopy(output, output, out); err != nil {
-		return errors.Wrap(err, "failed to copy logs to output")
+	if strategy == pgUpgradeStrategyLogical {
+		if err := upgradePostgresLogical(path, oldVersion, newVersion, upgradeDir, output); err != nil {
+			if b, ok := output.(*bytes.Buffer); ok && !verbose {
+				log.Print(b.String())
+			}
+			return errors.Wrap(err, "postgres upgrade failed")
+		}
 	}
 
 	// Run the /postgres-optimize.sh in the same dir as the *.sql and *.sh scripts
@@ -245,27 +244,29 @@ func maybeUpgradePostgres(path, newVersion string) error {
 	return nil
 }
 
-// HostMountpoint finds the Docker host mountpoint corresponding to the given path
-// in the container with the given id, if any.
-func hostMountPoint(ctx context.Context, cli *docker.Client, id, path string) (string, error) {
-	c, err := cli.ContainerInspect(ctx, id)
+// hostUpgradePaths resolves the host-filesystem paths (outside our own container) that the
+// tianon/postgres-upgrade image needs bind-mounted into the sibling container it runs in, by
+// asking the containerRuntime where path's parent directory is mounted from on the host. It's
+// only needed by pgUpgradeStrategyImage; pgUpgradeStrategyLogical runs entirely within our own
+// container and never calls this.
+func hostUpgradePaths(ctx context.Context, path, upgradeDir string) (rt containerRuntime, hostUpgradeDir, hostPath string, err error) {
+	id, err := containerID()
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to inspect container %q", id)
+		return nil, "", "", errors.Wrap(err, "failed to determine running container id")
 	}
 
-	for _, bind := range c.HostConfig.Binds {
-		if ps := strings.SplitN(bind, ":", 2); len(ps) == 2 && ps[1] == path {
-			return ps[0], nil
-		}
+	rt, err = newContainerRuntime()
+	if err != nil {
+		return nil, "", "", errors.Wrap(err, "failed to initialise container runtime")
 	}
 
-	for _, mount := range c.Mounts {
-		if mount.Destination == path {
-			return mount.Source, nil
-		}
+	hostDataDir, err := rt.HostMountPoint(ctx, id, filepath.Dir(path))
+	if err != nil {
+		return nil, "", "", errors.Wrap(err, "failed to determine host mount point")
 	}
 
-	return "", fmt.Errorf("couldn't find host mountpoint of %q on container %q", path, id)
+	// e.g: ~/.sourcegraph/data/postgresql
+	return rt, filepath.Join(hostDataDir, filepath.Base(upgradeDir)), filepath.Join(hostDataDir, filepath.Base(path)), nil
 }
 
 // containerID retrieves the Docker container id of the running container
@@ -0,0 +1,118 @@
+package shared
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pgUpgradeStrategy selects how maybeUpgradePostgres performs a major-version upgrade.
+type pgUpgradeStrategy int
+
+const (
+	// pgUpgradeStrategyImage runs the official tianon/postgres-upgrade:<old>-to-<new> image
+	// through the containerRuntime, binding both data directories into it. This is the default,
+	// fastest path, but that image is not published for every version pair, and it requires
+	// access to a Docker (or Podman) socket.
+	pgUpgradeStrategyImage pgUpgradeStrategy = iota
+
+	// pgUpgradeStrategyLogical upgrades via pg_dumpall: it starts the old binaries against the
+	// existing data dir, dumps it with pg_dumpall, initdb's a fresh cluster with the new
+	// binaries, and replays the dump into it. It's slower and requires both sets of binaries to
+	// be available, but works for any version pair and needs no container socket at all.
+	pgUpgradeStrategyLogical
+)
+
+// envPGUpgradeStrategy, when set to "logical", forces pgUpgradeStrategyLogical regardless of
+// pgUpgradeImagePairs.
+const envPGUpgradeStrategy = "PG_UPGRADE_STRATEGY"
+
+// pgUpgradeImagePairs lists the old-to-new version pairs that tianon/postgres-upgrade is
+// published for. Pairs not listed here fall back to pgUpgradeStrategyLogical automatically.
+var pgUpgradeImagePairs = map[string]bool{
+	"9.6-10": true, "9.6-11": true, "9.6-12": true,
+	"10-11": true, "10-12": true, "10-13": true,
+	"11-12": true, "11-13": true, "11-14": true,
+	"12-13": true, "12-14": true, "12-15": true,
+	"13-14": true, "13-15": true, "13-16": true,
+	"14-15": true, "14-16": true,
+	"15-16": true,
+}
+
+// pgUpgradeStrategyFor picks the upgrade strategy for oldVersion→newVersion, honoring
+// PG_UPGRADE_STRATEGY=logical and otherwise preferring the upgrade image when it's known to be
+// published for that pair.
+func pgUpgradeStrategyFor(oldVersion, newVersion string) pgUpgradeStrategy {
+	if strings.TrimSpace(os.Getenv(envPGUpgradeStrategy)) == "logical" {
+		return pgUpgradeStrategyLogical
+	}
+	if pgUpgradeImagePairs[oldVersion+"-"+newVersion] {
+		return pgUpgradeStrategyImage
+	}
+	return pgUpgradeStrategyLogical
+}
+
+// isImagePullNotFoundErr reports whether err looks like a registry "no such image/tag" error, as
+// opposed to e.g. a network failure, so callers can decide whether falling back to
+// pgUpgradeStrategyLogical is appropriate.
+func isImagePullNotFoundErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "not found") || strings.Contains(msg, "manifest unknown")
+}
+
+// pgBinDir returns the directory containing the Postgres binaries (pg_ctl, initdb, pg_dumpall,
+// psql, ...) for the given major version. Images that support the logical upgrade path bundle
+// the binaries for every supported version under /usr/lib/postgresql/<version>/bin, following
+// the layout used by the postgresql-common Debian packages.
+func pgBinDir(version string) string {
+	return filepath.Join("/usr/lib/postgresql", version, "bin")
+}
+
+// upgradePostgresLogical upgrades path from oldVersion to newVersion by starting the old binaries
+// against it, dumping with pg_dumpall, initdb'ing a fresh cluster with the new binaries at
+// path-<newVersion>, and replaying the dump into it. It leaves path and path-<newVersion> in
+// place, same as the tianon/postgres-upgrade image does, so the caller can finish with the same
+// rename-and-optimize step used by the image strategy.
+func upgradePostgresLogical(path, oldVersion, newVersion, upgradeDir string, output io.Writer) error {
+	oldBin := pgBinDir(oldVersion)
+	newBin := pgBinDir(newVersion)
+	newPath := path + "-" + newVersion
+	dumpFile := filepath.Join(upgradeDir, "dump.sql")
+
+	start := execer{Out: output}
+	start.Command("su-exec", "postgres", filepath.Join(oldBin, "pg_ctl"), "-D", path, "-o -c listen_addresses=127.0.0.1", "-l", "/tmp/pgsql-upgrade-old.log", "-w", "start")
+	if err := start.Error(); err != nil {
+		return errors.Wrap(err, "failed to start old Postgres for logical upgrade")
+	}
+
+	dump := execer{Out: output}
+	dump.Command("su-exec", "postgres", filepath.Join(oldBin, "pg_dumpall"), "--clean", "--if-exists", "-f", dumpFile)
+	dump.Command("su-exec", "postgres", filepath.Join(oldBin, "pg_ctl"), "-D", path, "-m", "fast", "-l", "/tmp/pgsql-upgrade-old.log", "-w", "stop")
+	if err := dump.Error(); err != nil {
+		return errors.Wrap(err, "failed to dump old Postgres for logical upgrade")
+	}
+
+	initAndStart := execer{Out: output}
+	initAndStart.Command("mkdir", "-p", newPath)
+	initAndStart.Command("chown", "postgres", newPath)
+	initAndStart.Command("su-exec", "postgres", filepath.Join(newBin, "initdb"), "-D", newPath, "--nosync")
+	initAndStart.Command("su-exec", "postgres", filepath.Join(newBin, "pg_ctl"), "-D", newPath, "-o -c listen_addresses=127.0.0.1", "-l", "/tmp/pgsql-upgrade-new.log", "-w", "start")
+	if err := initAndStart.Error(); err != nil {
+		return errors.Wrap(err, "failed to initialise new Postgres for logical upgrade")
+	}
+
+	restore := execer{Out: output}
+	restore.Command("su-exec", "postgres", filepath.Join(newBin, "psql"), "-v", "ON_ERROR_STOP=1", "-f", dumpFile)
+	restore.Command("su-exec", "postgres", filepath.Join(newBin, "pg_ctl"), "-D", newPath, "-m", "fast", "-l", "/tmp/pgsql-upgrade-new.log", "-w", "stop")
+	if err := restore.Error(); err != nil {
+		return errors.Wrap(err, "failed to replay pg_dumpall output into new Postgres")
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package shared
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPgUpgradeStrategyFor(t *testing.T) {
+	tests := []struct {
+		old, new string
+		want     pgUpgradeStrategy
+	}{
+		{old: "11", new: "12", want: pgUpgradeStrategyImage},    // listed in pgUpgradeImagePairs
+		{old: "9.4", new: "12", want: pgUpgradeStrategyLogical}, // not listed, falls back
+		{old: "16", new: "17", want: pgUpgradeStrategyLogical},  // not listed, falls back
+	}
+
+	for _, tt := range tests {
+		if got := pgUpgradeStrategyFor(tt.old, tt.new); got != tt.want {
+			t.Errorf("pgUpgradeStrategyFor(%q, %q) = %v, want %v", tt.old, tt.new, got, tt.want)
+		}
+	}
+}
+
+func TestPgUpgradeStrategyFor_forcedLogical(t *testing.T) {
+	old, had := os.LookupEnv(envPGUpgradeStrategy)
+	os.Setenv(envPGUpgradeStrategy, "logical")
+	defer func() {
+		if had {
+			os.Setenv(envPGUpgradeStrategy, old)
+		} else {
+			os.Unsetenv(envPGUpgradeStrategy)
+		}
+	}()
+
+	if got := pgUpgradeStrategyFor("11", "12"); got != pgUpgradeStrategyLogical {
+		t.Errorf("pgUpgradeStrategyFor with %s=logical = %v, want pgUpgradeStrategyLogical", envPGUpgradeStrategy, got)
+	}
+}
+
+func TestIsImagePullNotFoundErr(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: false},
+		{err: errNotFoundLike("manifest for tianon/postgres-upgrade:9.4-to-12 not found"), want: true},
+		{err: errNotFoundLike("manifest unknown"), want: true},
+		{err: errNotFoundLike("connection refused"), want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isImagePullNotFoundErr(tt.err); got != tt.want {
+			t.Errorf("isImagePullNotFoundErr(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+type errNotFoundLike string
+
+func (e errNotFoundLike) Error() string { return string(e) }
+
+func TestPgBinDir(t *testing.T) {
+	if got, want := pgBinDir("12"), filepath.Join("/usr/lib/postgresql", "12", "bin"); got != want {
+		t.Errorf("pgBinDir(12) = %q, want %q", got, want)
+	}
+}
+
+// TestUpgradePostgresLogical_EndToEnd exercises the actual pg_dumpall/psql round-trip that
+// upgradePostgresLogical performs against a real (tiny) cluster: it initializes a data directory
+// with the older binaries, creates a table, a role, and an extension, runs the upgrade, and
+// verifies all three survived in the new cluster.
+//
+// That needs an environment with at least two Postgres major versions' binaries installed under
+// /usr/lib/postgresql/<version>/bin (the layout pgBinDir assumes), su-exec, and a "postgres"
+// system user to drop privileges to. None of those are available in this sandbox, so the test
+// skips itself when a precondition is missing rather than asserting a fake pass; wherever it does
+// run (e.g. the docker-library/postgres-based CI image), it exercises the real dump/restore path
+// the unit tests above can't reach.
+func TestUpgradePostgresLogical_EndToEnd(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("upgradePostgresLogical shells out via su-exec, which needs root")
+	}
+	if _, err := user.Lookup("postgres"); err != nil {
+		t.Skip(`no "postgres" system user to run the cluster as`)
+	}
+	if _, err := exec.LookPath("su-exec"); err != nil {
+		t.Skip("su-exec not on PATH")
+	}
+	oldVersion, newVersion, ok := twoInstalledPgVersions()
+	if !ok {
+		t.Skip("fewer than two Postgres major versions installed under /usr/lib/postgresql")
+	}
+
+	dataRoot := t.TempDir()
+	path := filepath.Join(dataRoot, "postgresql")
+	upgradeDir := filepath.Join(dataRoot, "upgrade")
+	if err := os.MkdirAll(upgradeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	seed := execer{Out: &output}
+	seed.Command("mkdir", "-p", path)
+	seed.Command("chown", "postgres", path)
+	seed.Command("su-exec", "postgres", filepath.Join(pgBinDir(oldVersion), "initdb"), "-D", path, "--nosync")
+	seed.Command("su-exec", "postgres", filepath.Join(pgBinDir(oldVersion), "pg_ctl"), "-D", path, "-o -c listen_addresses=127.0.0.1", "-l", "/tmp/pgsql-upgrade-test-old.log", "-w", "start")
+	seed.Command("su-exec", "postgres", filepath.Join(pgBinDir(oldVersion), "psql"), "-v", "ON_ERROR_STOP=1", "-c",
+		"CREATE ROLE upgrade_test_role LOGIN; CREATE TABLE upgrade_test(id int); INSERT INTO upgrade_test VALUES (1), (2); CREATE EXTENSION IF NOT EXISTS pgcrypto;")
+	seed.Command("su-exec", "postgres", filepath.Join(pgBinDir(oldVersion), "pg_ctl"), "-D", path, "-m", "fast", "-l", "/tmp/pgsql-upgrade-test-old.log", "-w", "stop")
+	if err := seed.Error(); err != nil {
+		t.Fatalf("failed to seed old cluster: %v\n%s", err, output.String())
+	}
+
+	output.Reset()
+	if err := upgradePostgresLogical(path, oldVersion, newVersion, upgradeDir, &output); err != nil {
+		t.Fatalf("upgradePostgresLogical failed: %v\n%s", err, output.String())
+	}
+
+	newPath := path + "-" + newVersion
+	newCtl := filepath.Join(pgBinDir(newVersion), "pg_ctl")
+	newPsql := filepath.Join(pgBinDir(newVersion), "psql")
+	if out, err := exec.Command("su-exec", "postgres", newCtl, "-D", newPath, "-o -c listen_addresses=127.0.0.1", "-l", "/tmp/pgsql-upgrade-test-new.log", "-w", "start").CombinedOutput(); err != nil {
+		t.Fatalf("failed to start upgraded cluster: %v\n%s", err, out)
+	}
+	defer exec.Command("su-exec", "postgres", newCtl, "-D", newPath, "-m", "fast", "-w", "stop").Run()
+
+	rows, err := exec.Command("su-exec", "postgres", newPsql, "-tAc", "SELECT count(*) FROM upgrade_test").Output()
+	if err != nil || strings.TrimSpace(string(rows)) != "2" {
+		t.Errorf("upgrade_test table did not survive the upgrade: rows=%q err=%v", rows, err)
+	}
+	role, err := exec.Command("su-exec", "postgres", newPsql, "-tAc", "SELECT 1 FROM pg_roles WHERE rolname='upgrade_test_role'").Output()
+	if err != nil || strings.TrimSpace(string(role)) != "1" {
+		t.Errorf("upgrade_test_role did not survive the upgrade: out=%q err=%v", role, err)
+	}
+	ext, err := exec.Command("su-exec", "postgres", newPsql, "-tAc", "SELECT 1 FROM pg_extension WHERE extname='pgcrypto'").Output()
+	if err != nil || strings.TrimSpace(string(ext)) != "1" {
+		t.Errorf("pgcrypto extension did not survive the upgrade: out=%q err=%v", ext, err)
+	}
+}
+
+// twoInstalledPgVersions returns the two lowest installed Postgres major versions under
+// /usr/lib/postgresql, sorted ascending, for use as the old/new pair in
+// TestUpgradePostgresLogical_EndToEnd.
+func twoInstalledPgVersions() (old, new string, ok bool) {
+	entries, err := os.ReadDir("/usr/lib/postgresql")
+	if err != nil {
+		return "", "", false
+	}
+
+	var versions []string
+	for _, e := range entries {
+		if e.IsDir() {
+			versions = append(versions, e.Name())
+		}
+	}
+	if len(versions) < 2 {
+		return "", "", false
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		vi, _ := strconv.ParseFloat(versions[i], 64)
+		vj, _ := strconv.ParseFloat(versions[j], 64)
+		return vi < vj
+	})
+	return versions[0], versions[1], true
+}
@@ -2,14 +2,42 @@ package storage
 
 import (
 	"fmt"
+	"hash/crc32"
+	"io"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"sourcegraph.com/sourcegraph/go-sourcegraph/sourcegraph"
 )
 
+// defaultChunkSize is the amount of data transferred per streamed chunk. It bounds how much a
+// single gRPC message has to buffer on either side of a Read or Write, so large transfers don't
+// require allocating a matching in-memory buffer for the whole file.
+const defaultChunkSize = 256 * 1024
+
+// maxStreamRetries is how many times a transient stream error (Unavailable, DeadlineExceeded) is
+// retried, reopening the stream and resuming from the current offset, before giving up.
+const maxStreamRetries = 3
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
 type file struct {
 	fs     *fileSystem
 	name   *sourcegraph.StorageName
 	offset int64
+
+	readStream sourcegraph.Storage_ReadClient
+	readBuf    []byte // unconsumed bytes from the most recently received chunk
+
+	writeStream sourcegraph.Storage_WriteClient
+
+	// unackedChunks holds every chunk sent on writeStream (or a writeStream it replaced) since
+	// the last successful Close. gRPC client-streaming Sends aren't acknowledged per-message, so
+	// when a Send fails there's no way to know whether an earlier, already-"sent" chunk actually
+	// reached the server; resendUnackedChunks replays all of them rather than just the one whose
+	// Send errored.
+	unackedChunks []*sourcegraph.StorageWriteChunk
 }
 
 func (f *file) Name() string {
@@ -20,29 +48,182 @@ func (f *file) String() string {
 	return fmt.Sprintf("File(%q, FileSystem=%v)", f.name.Name, f.fs)
 }
 
+// Read implements io.Reader by pulling fixed-size chunks off a long-lived server-streaming
+// Storage.Read call instead of issuing one RPC per Read. The stream is transparently reopened,
+// resuming at the current offset, on a transient error or after a Seek.
 func (f *file) Read(p []byte) (n int, err error) {
-	resp, grpcErr := f.fs.client.Storage.Read(f.fs.ctx, &sourcegraph.StorageReadOp{
-		Name:   *f.name,
-		Offset: f.offset,
-		Count:  int64(len(p)),
-	})
-	if grpcErr != nil {
-		return 0, grpcErr
+	for n < len(p) {
+		if len(f.readBuf) == 0 {
+			if err := f.fillReadBuf(); err != nil {
+				if n > 0 && err == io.EOF {
+					return n, nil
+				}
+				return n, err
+			}
+		}
+		c := copy(p[n:], f.readBuf)
+		f.readBuf = f.readBuf[c:]
+		n += c
+		f.offset += int64(c)
 	}
-	copy(resp.Data, p)
-	return len(resp.Data), storageError(&resp.Error)
+	return n, nil
 }
 
+// WriteTo implements io.WriterTo so that callers copying a file to e.g. an *os.File via io.Copy
+// skip the extra buffer io.Copy would otherwise allocate.
+func (f *file) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if len(f.readBuf) == 0 {
+			if err := f.fillReadBuf(); err != nil {
+				if err == io.EOF {
+					return n, nil
+				}
+				return n, err
+			}
+		}
+		wrote, werr := w.Write(f.readBuf)
+		n += int64(wrote)
+		f.offset += int64(wrote)
+		f.readBuf = f.readBuf[wrote:]
+		if werr != nil {
+			return n, werr
+		}
+	}
+}
+
+// fillReadBuf receives the next chunk from the read stream (opening or reopening it as needed)
+// into f.readBuf, validating its CRC32C checksum.
+func (f *file) fillReadBuf() error {
+	for attempt := 0; ; attempt++ {
+		if f.readStream == nil {
+			stream, err := f.fs.client.Storage.Read(f.fs.ctx, &sourcegraph.StorageReadOp{
+				Name:      *f.name,
+				Offset:    f.offset,
+				ChunkSize: defaultChunkSize,
+			})
+			if err != nil {
+				return err
+			}
+			f.readStream = stream
+		}
+
+		chunk, err := f.readStream.Recv()
+		if err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			f.readStream = nil
+			if isRetryableStreamErr(err) && attempt < maxStreamRetries {
+				continue
+			}
+			return err
+		}
+		if err := storageError(&chunk.Error); err != nil {
+			return err
+		}
+		if crc32.Checksum(chunk.Data, crc32cTable) != chunk.Checksum {
+			f.readStream = nil
+			if attempt < maxStreamRetries {
+				continue
+			}
+			return fmt.Errorf("storage: chunk checksum mismatch reading %q at offset %d", f.name.Name, f.offset)
+		}
+
+		f.readBuf = chunk.Data
+		return nil
+	}
+}
+
+// Write implements io.Writer by batching data into a long-lived client-streaming Storage.Write
+// call instead of issuing one RPC per Write. The stream is only finalized, and the write made
+// durable, when Close is called.
 func (f *file) Write(p []byte) (n int, err error) {
-	resp, grpcErr := f.fs.client.Storage.Write(f.fs.ctx, &sourcegraph.StorageWriteOp{
-		Name:   *f.name,
-		Offset: f.offset,
-		Data:   p,
-	})
-	if grpcErr != nil {
-		return 0, grpcErr
+	for n < len(p) {
+		end := n + defaultChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		chunk := p[n:end]
+		if err := f.sendChunk(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		f.offset += int64(len(chunk))
+	}
+	return n, nil
+}
+
+// ReadFrom implements io.ReaderFrom so that callers copying e.g. an *os.File into a file via
+// io.Copy skip the extra buffer io.Copy would otherwise allocate.
+func (f *file) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := make([]byte, defaultChunkSize)
+	for {
+		nr, rerr := r.Read(buf)
+		if nr > 0 {
+			if err := f.sendChunk(buf[:nr]); err != nil {
+				return n, err
+			}
+			n += int64(nr)
+			f.offset += int64(nr)
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// sendChunk sends one chunk on the write stream (opening it first if necessary), replaying every
+// not-yet-durable chunk onto the new stream first if a transient error forces it to reopen.
+func (f *file) sendChunk(data []byte) error {
+	chunk := &sourcegraph.StorageWriteChunk{
+		Name:     *f.name,
+		Offset:   f.offset,
+		Data:     data,
+		Checksum: crc32.Checksum(data, crc32cTable),
+	}
+
+	for attempt := 0; ; attempt++ {
+		if f.writeStream == nil {
+			stream, err := f.fs.client.Storage.Write(f.fs.ctx)
+			if err != nil {
+				return err
+			}
+			f.writeStream = stream
+
+			if err := f.resendUnackedChunks(); err != nil {
+				f.writeStream = nil
+				if isRetryableStreamErr(err) && attempt < maxStreamRetries {
+					continue
+				}
+				return err
+			}
+		}
+
+		err := f.writeStream.Send(chunk)
+		if err == nil {
+			f.unackedChunks = append(f.unackedChunks, chunk)
+			return nil
+		}
+		f.writeStream = nil
+		if !isRetryableStreamErr(err) || attempt >= maxStreamRetries {
+			return err
+		}
 	}
-	return int(resp.Wrote), storageError(resp.Error)
+}
+
+// resendUnackedChunks replays every chunk accumulated in f.unackedChunks onto the freshly
+// (re)opened f.writeStream, so reopening the stream after a transient error can't silently drop a
+// chunk the caller already considers sent.
+func (f *file) resendUnackedChunks() error {
+	for _, chunk := range f.unackedChunks {
+		if err := f.writeStream.Send(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (f *file) Seek(offset int64, whence int) (int64, error) {
@@ -63,13 +244,44 @@ func (f *file) Seek(offset int64, whence int) (int64, error) {
 	default:
 		panic("File.Seek: invalid whence value")
 	}
+
+	// The read stream is positional: there's no way to jump it to a new offset mid-stream, so
+	// drop it and let the next Read reopen it at the new offset.
+	f.readStream = nil
+	f.readBuf = nil
+
 	return f.offset, nil
 }
 
 func (f *file) Close() error {
+	var writeErr error
+	if f.writeStream != nil {
+		_, writeErr = f.writeStream.CloseAndRecv()
+		f.writeStream = nil
+		if writeErr == nil {
+			// CloseAndRecv succeeding is the only point at which every chunk written so far is
+			// actually confirmed durable.
+			f.unackedChunks = nil
+		}
+	}
+
 	ioErr, grpcErr := f.fs.client.Storage.Close(f.fs.ctx, f.name)
 	if grpcErr != nil {
 		return grpcErr
 	}
-	return storageError(ioErr)
+	if err := storageError(ioErr); err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// isRetryableStreamErr reports whether err is a transient gRPC error worth retrying by reopening
+// the stream and resuming from the current offset.
+func isRetryableStreamErr(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
 }
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIsRetryableStreamErr(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: false},
+		{err: io.EOF, want: false},
+		{err: status.Error(codes.Unavailable, "server unavailable"), want: true},
+		{err: status.Error(codes.DeadlineExceeded, "deadline exceeded"), want: true},
+		{err: status.Error(codes.PermissionDenied, "no access"), want: false},
+		{err: errors.New("some other error"), want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isRetryableStreamErr(tt.err); got != tt.want {
+			t.Errorf("isRetryableStreamErr(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestCrc32cTableMatchesChunkChecksums(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	got := crc32.Checksum(data, crc32cTable)
+	want := crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+	if got != want {
+		t.Errorf("crc32cTable produced %d, want %d (IEEE/Castagnoli mismatch)", got, want)
+	}
+
+	// A single bit flip must change the checksum, or corruption on the wire would go undetected.
+	corrupted := append([]byte(nil), data...)
+	corrupted[0] ^= 0x01
+	if crc32.Checksum(corrupted, crc32cTable) == got {
+		t.Error("checksum did not change after corrupting the data")
+	}
+}
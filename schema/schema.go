@@ -0,0 +1,18 @@
+package schema
+
+// SAMLAuthProvider describes a SAML 2.0 authentication provider in site configuration's
+// "auth.providers" (type "saml").
+//
+// NOTE: this is a partial reconstruction covering only the fields
+// cmd/frontend/internal/auth/saml references in this checkout. The full schema.go, generated from
+// schema/site.schema.json, lives outside this snapshot.
+type SAMLAuthProvider struct {
+	// NameIDFormat is the SAML NameID format requested of the identity provider. Defaults to
+	// "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent" so that re-linking a user across
+	// logins doesn't depend on the IdP sending a stable email attribute.
+	NameIDFormat string `json:"nameIDFormat,omitempty"`
+
+	// SignLogoutRequests, if true, signs outgoing SAML LogoutRequest/LogoutResponse documents
+	// with the service provider's private key.
+	SignLogoutRequests bool `json:"signLogoutRequests,omitempty"`
+}